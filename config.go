@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const configFileName = ".preffixer.yaml"
+
+// config describes rules applied to a repository, read from its .preffixer.yaml file:
+//
+//	rules:
+//	- pattern: "*.go"
+//	  prefix_file: hack/boilerplate.go.txt
+//	  with_line_end: true
+type config struct {
+	Rules []configRule `yaml:"rules"`
+}
+
+type configRule struct {
+	Pattern     string `yaml:"pattern"`
+	Prefix      string `yaml:"prefix"`
+	PrefixFile  string `yaml:"prefix_file"`
+	WithLineEnd bool   `yaml:"with_line_end"`
+
+	// line in the config file on which the rule starts
+	line int
+}
+
+// resolvedRule is a valid config rule with its prefix loaded.
+type resolvedRule struct {
+	configRule
+	prefix string
+}
+
+func configCommand() *cobra.Command {
+	newCmd := &cobra.Command{
+		Use:   "config",
+		Short: fmt.Sprintf("Inspect %s config file.", configFileName),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Usage()
+		},
+	}
+
+	newCmd.AddCommand(&cobra.Command{
+		Use:     "validate [CONFIG_PATH]",
+		Short:   "Validate config file, reporting all problems found with their line numbers.",
+		Example: `preffixer config validate ./.preffixer.yaml`,
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := configPathArg(args)
+			rules, err := loadConfigRules(path, cmd.OutOrStdout())
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Config file %s is valid, it defines %d rules\n", path, len(rules))
+			return nil
+		},
+	})
+	newCmd.AddCommand(&cobra.Command{
+		Use:     "show [CONFIG_PATH]",
+		Short:   "Print effective rules defined by config file, with prefixes resolved.",
+		Example: `preffixer config show ./.preffixer.yaml`,
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := configPathArg(args)
+			rules, err := loadConfigRules(path, cmd.OutOrStdout())
+			if err != nil {
+				return err
+			}
+			printRules(cmd.OutOrStdout(), path, rules)
+			return nil
+		},
+	})
+
+	return newCmd
+}
+
+func configPathArg(args []string) string {
+	if len(args) == 0 || args[0] == "" {
+		return configFileName
+	}
+	return args[0]
+}
+
+// loadConfigRules loads rules from the config file, printing every problem found to out.
+func loadConfigRules(path string, out io.Writer) ([]resolvedRule, error) {
+	rules, problems, err := readConfigRules(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(out, p)
+		}
+		return nil, fmt.Errorf("config file %s is invalid, problems found: %d", path, len(problems))
+	}
+	return rules, nil
+}
+
+func printRules(out io.Writer, path string, rules []resolvedRule) {
+	fmt.Fprintf(out, "Config file: %s\n", path)
+	for i, r := range rules {
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "Rule %d (line %d):\n", i+1, r.line)
+		fmt.Fprintf(out, "  Pattern: %s\n", r.Pattern)
+		if r.PrefixFile != "" {
+			fmt.Fprintf(out, "  Prefix file: %s\n", r.PrefixFile)
+		}
+		fmt.Fprintf(out, "  With line end: %t\n", r.WithLineEnd)
+		fmt.Fprintln(out, "  Prefix:")
+		for _, line := range strings.Split(strings.TrimSuffix(r.prefix, "\n"), "\n") {
+			fmt.Fprintf(out, "    %s\n", line)
+		}
+	}
+}
+
+// loadConfig loads rules from the config file, returning all problems found as a single error.
+func loadConfig(path string) ([]resolvedRule, error) {
+	rules, problems, err := readConfigRules(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		msgs := make([]string, 0, len(problems))
+		for _, p := range problems {
+			msgs = append(msgs, p.Error())
+		}
+		return nil, fmt.Errorf("config file %s is invalid: %s", path, strings.Join(msgs, "; "))
+	}
+	return rules, nil
+}
+
+// readConfigRules reads the config file and resolves its rules. Problems with the
+// content of the file, like unknown fields or invalid values, are returned along
+// with their line numbers, while the error is returned only if the file could not
+// be read or is not a valid YAML.
+func readConfigRules(path string) ([]resolvedRule, []error, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read config file")
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	var cfg config
+	problems := []error{}
+	if err := decoder.Decode(&cfg); err != nil && err != io.EOF {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return nil, nil, errors.Wrapf(err, "failed to parse config file %s", path)
+		}
+		// Remaining fields are still decoded, so rules can be validated further
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, errors.New(msg))
+		}
+	}
+
+	// Decode once more to find out where each rule starts
+	var nodes struct {
+		Rules []yaml.Node `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(content, &nodes); err == nil {
+		for i := range cfg.Rules {
+			if i < len(nodes.Rules) {
+				cfg.Rules[i].line = nodes.Rules[i].Line
+			}
+		}
+	}
+
+	rules, ruleProblems := cfg.resolveRules(filepath.Dir(path))
+	return rules, append(problems, ruleProblems...), nil
+}
+
+// resolveRules validates the rules and loads their prefixes, reading prefix files
+// relative to baseDir. All problems found are returned.
+func (c config) resolveRules(baseDir string) ([]resolvedRule, []error) {
+	if len(c.Rules) == 0 {
+		return nil, []error{fmt.Errorf("no rules defined")}
+	}
+
+	rules := make([]resolvedRule, 0, len(c.Rules))
+	problems := []error{}
+	for i, rule := range c.Rules {
+		if err := rule.validate(); err != nil {
+			problems = append(problems, errors.Wrapf(err, "line %d: rule %d", rule.line, i+1))
+			continue
+		}
+		prefix, err := rule.resolvePrefix(baseDir)
+		if err != nil {
+			problems = append(problems, errors.Wrapf(err, "line %d: rule %d", rule.line, i+1))
+			continue
+		}
+		rules = append(rules, resolvedRule{configRule: rule, prefix: prefix})
+	}
+
+	return rules, problems
+}
+
+func (r configRule) validate() error {
+	if r.Pattern == "" {
+		return fmt.Errorf("pattern not provided")
+	}
+	if _, err := filepath.Match(r.Pattern, ""); err != nil {
+		return errors.Wrapf(err, "invalid pattern %q", r.Pattern)
+	}
+	if r.Prefix != "" && r.PrefixFile != "" {
+		return fmt.Errorf("only one of prefix and prefix_file can be specified")
+	}
+	if r.Prefix == "" && r.PrefixFile == "" {
+		return fmt.Errorf("prefix not provided, specify prefix or prefix_file")
+	}
+	return nil
+}
+
+// resolvePrefix returns the prefix of the rule, reading it from the prefix file
+// relative to baseDir if needed.
+func (r configRule) resolvePrefix(baseDir string) (string, error) {
+	if r.Prefix != "" {
+		return r.Prefix, nil
+	}
+
+	prefixFile := r.PrefixFile
+	if !filepath.IsAbs(prefixFile) {
+		prefixFile = filepath.Join(baseDir, prefixFile)
+	}
+	prefix, err := loadFile(prefixFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to load content of prefix file")
+	}
+	if prefix == "" {
+		return "", fmt.Errorf("prefix file %s is empty", prefixFile)
+	}
+	return prefix, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, configFileName)
+
+	t.Run("valid config", func(t *testing.T) {
+		writeTestFiles(t, dir, map[string]string{
+			configFileName: `rules:
+- pattern: "*.go"
+  prefix_file: hack/license.txt
+  with_line_end: true
+- pattern: "*.sh"
+  prefix: "# Copyright"
+`,
+			"hack/license.txt": "// Copyright\n// All rights reserved\n",
+		})
+
+		cmd, out := getCmd()
+		cmd.SetArgs([]string{"config", "validate", configPath})
+		err := cmd.Execute()
+		require.NoError(t, err)
+		assert.Contains(t, out.String(), "is valid, it defines 2 rules")
+
+		cmd, out = getCmd()
+		cmd.SetArgs([]string{"config", "show", configPath})
+		err = cmd.Execute()
+		require.NoError(t, err)
+		assert.Contains(t, out.String(), `Rule 1 (line 2):
+  Pattern: *.go
+  Prefix file: hack/license.txt
+  With line end: true
+  Prefix:
+    // Copyright
+    // All rights reserved
+`)
+		assert.Contains(t, out.String(), `Rule 2 (line 5):
+  Pattern: *.sh
+  With line end: false
+  Prefix:
+    # Copyright
+`)
+	})
+
+	t.Run("report all problems with line numbers", func(t *testing.T) {
+		writeTestFiles(t, dir, map[string]string{
+			configFileName: `rules:
+- pattern: "*.go"
+  prefx: "// Copyright"
+- pattern: "["
+  prefix: "// Copyright"
+- pattern: "*.sh"
+  prefix_file: missing.txt
+- pattern: "*.md"
+  with_line_end: maybe
+  prefix: "Copyright"
+`,
+		})
+
+		cmd, out := getCmd()
+		cmd.SetArgs([]string{"config", "validate", configPath})
+		err := cmd.Execute()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "problems found: 5")
+		assert.Contains(t, out.String(), "line 3: field prefx not found")
+		assert.Contains(t, out.String(), "line 9: cannot unmarshal !!str `maybe`")
+		assert.Contains(t, out.String(), "line 2: rule 1: prefix not provided")
+		assert.Contains(t, out.String(), "line 4: rule 2: invalid pattern")
+		assert.Contains(t, out.String(), "line 6: rule 3: failed to load content of prefix file")
+
+		cmd, _ = getCmd()
+		cmd.SetArgs([]string{"config", "show", configPath})
+		err = cmd.Execute()
+		require.Error(t, err)
+	})
+
+	t.Run("invalid yaml", func(t *testing.T) {
+		writeTestFiles(t, dir, map[string]string{configFileName: "rules: [\n"})
+
+		cmd, _ := getCmd()
+		cmd.SetArgs([]string{"config", "validate", configPath})
+		err := cmd.Execute()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to parse config file")
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	fileTypeUnknown    = "unknown"
+	fileTypeGo         = "go"
+	fileTypeShell      = "shell"
+	fileTypePython     = "python"
+	fileTypeRuby       = "ruby"
+	fileTypePerl       = "perl"
+	fileTypePHP        = "php"
+	fileTypeJavaScript = "javascript"
+	fileTypeTypeScript = "typescript"
+	fileTypeXML        = "xml"
+	fileTypeYAML       = "yaml"
+	fileTypeJSON       = "json"
+	fileTypeMarkdown   = "markdown"
+	fileTypeText       = "text"
+	fileTypeDockerfile = "dockerfile"
+	fileTypeMakefile   = "makefile"
+)
+
+var knownFileTypes = []string{
+	fileTypeGo, fileTypeShell, fileTypePython, fileTypeRuby, fileTypePerl, fileTypePHP,
+	fileTypeJavaScript, fileTypeTypeScript, fileTypeXML, fileTypeYAML, fileTypeJSON,
+	fileTypeMarkdown, fileTypeText, fileTypeDockerfile, fileTypeMakefile, fileTypeUnknown,
+}
+
+var extensionFileTypes = map[string]string{
+	".go":         fileTypeGo,
+	".sh":         fileTypeShell,
+	".bash":       fileTypeShell,
+	".zsh":        fileTypeShell,
+	".py":         fileTypePython,
+	".rb":         fileTypeRuby,
+	".pl":         fileTypePerl,
+	".pm":         fileTypePerl,
+	".php":        fileTypePHP,
+	".js":         fileTypeJavaScript,
+	".mjs":        fileTypeJavaScript,
+	".ts":         fileTypeTypeScript,
+	".xml":        fileTypeXML,
+	".yaml":       fileTypeYAML,
+	".yml":        fileTypeYAML,
+	".json":       fileTypeJSON,
+	".md":         fileTypeMarkdown,
+	".txt":        fileTypeText,
+	".mk":         fileTypeMakefile,
+	".dockerfile": fileTypeDockerfile,
+}
+
+var interpreterFileTypes = map[string]string{
+	"sh":      fileTypeShell,
+	"bash":    fileTypeShell,
+	"zsh":     fileTypeShell,
+	"ksh":     fileTypeShell,
+	"dash":    fileTypeShell,
+	"python":  fileTypePython,
+	"ruby":    fileTypeRuby,
+	"perl":    fileTypePerl,
+	"php":     fileTypePHP,
+	"node":    fileTypeJavaScript,
+	"deno":    fileTypeTypeScript,
+	"ts-node": fileTypeTypeScript,
+}
+
+// textFileNames lists conventional extensionless plain text files, like LICENSE or NOTICE.
+var textFileNames = []string{"LICENSE", "LICENCE", "COPYING", "NOTICE", "AUTHORS", "CONTRIBUTORS", "README"}
+
+// preambleMarkers start first lines which must stay first for the file to work,
+// like shebang, PHP open tag or XML prolog.
+var preambleMarkers = []string{"#!", "<?php", "<?xml"}
+
+var interpreterVersionSuffix = regexp.MustCompile(`[0-9.]+$`)
+
+func isKnownFileType(fileType string) bool {
+	for _, ft := range knownFileTypes {
+		if ft == fileType {
+			return true
+		}
+	}
+	return false
+}
+
+// detectFileType determines the file type from its name, extension and, as a fallback,
+// its first line (shebang interpreter, PHP opening tag or XML prolog).
+func detectFileType(path string) (string, error) {
+	if fileType := fileTypeFromName(filepath.Base(path)); fileType != fileTypeUnknown {
+		return fileType, nil
+	}
+
+	firstLine, err := readFirstLine(path)
+	if err != nil {
+		return "", err
+	}
+	return fileTypeFromFirstLine(firstLine), nil
+}
+
+func fileTypeFromName(name string) string {
+	switch {
+	case name == "Dockerfile" || strings.HasPrefix(name, "Dockerfile."):
+		return fileTypeDockerfile
+	case name == "Makefile" || name == "makefile" || name == "GNUmakefile":
+		return fileTypeMakefile
+	}
+
+	if fileType, found := extensionFileTypes[strings.ToLower(filepath.Ext(name))]; found {
+		return fileType
+	}
+
+	for _, textName := range textFileNames {
+		if name == textName || strings.HasPrefix(name, textName+"-") || strings.HasPrefix(name, textName+".") {
+			return fileTypeText
+		}
+	}
+
+	return fileTypeUnknown
+}
+
+func fileTypeFromFirstLine(firstLine string) string {
+	switch {
+	case strings.HasPrefix(firstLine, "<?php"):
+		return fileTypePHP
+	case strings.HasPrefix(firstLine, "<?xml"):
+		return fileTypeXML
+	case strings.HasPrefix(firstLine, "#!"):
+		return fileTypeFromShebang(firstLine)
+	}
+	return fileTypeUnknown
+}
+
+func fileTypeFromShebang(shebang string) string {
+	fields := strings.Fields(strings.TrimPrefix(shebang, "#!"))
+	if len(fields) == 0 {
+		return fileTypeUnknown
+	}
+
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" {
+		// Skip env options such as -S
+		interpreter = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				interpreter = f
+				break
+			}
+		}
+	}
+
+	interpreter = interpreterVersionSuffix.ReplaceAllString(interpreter, "")
+	if fileType, found := interpreterFileTypes[interpreter]; found {
+		return fileType
+	}
+	return fileTypeUnknown
+}
+
+// splitPreamble splits content into its first line, if it is a preamble which has
+// to stay first, and the rest of the content.
+func splitPreamble(content string) (string, string) {
+	firstLine := content
+	end := strings.Index(content, "\n")
+	if end >= 0 {
+		firstLine = content[:end+1]
+	}
+
+	for _, marker := range preambleMarkers {
+		if strings.HasPrefix(firstLine, marker) {
+			return firstLine, content[len(firstLine):]
+		}
+	}
+	return "", content
+}
+
+// locatePrefix splits content into the part preceding the prefix and the rest, and
+// reports whether the rest starts with the prefix. Prefix is expected at the very
+// beginning of the content or right after the preamble. If it is not found, content
+// is split where the prefix should be injected.
+func locatePrefix(content, prefix string) (string, string, bool) {
+	if strings.HasPrefix(content, prefix) {
+		return "", content, true
+	}
+	preamble, rest := splitPreamble(content)
+	return preamble, rest, strings.HasPrefix(rest, prefix)
+}
+
+func filterFileTypes(files []string, fileTypes []string) ([]string, error) {
+	filtered := make([]string, 0, len(files))
+	for _, f := range files {
+		fileType, err := detectFileType(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to detect type of file %s", f)
+		}
+		for _, ft := range fileTypes {
+			if ft == fileType {
+				filtered = append(filtered, f)
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
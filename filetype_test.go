@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectFileType(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{name: "main.go", content: "package main", expected: fileTypeGo},
+		{name: "Dockerfile", content: "FROM alpine", expected: fileTypeDockerfile},
+		{name: "Dockerfile.dev", content: "FROM alpine", expected: fileTypeDockerfile},
+		{name: "Makefile", content: "all:", expected: fileTypeMakefile},
+		{name: "LICENSE", content: "Apache License", expected: fileTypeText},
+		{name: "LICENSE-MIT", content: "MIT License", expected: fileTypeText},
+		{name: "run", content: "#!/bin/bash\necho hello", expected: fileTypeShell},
+		{name: "run", content: "#!/usr/bin/env python3\nprint()", expected: fileTypePython},
+		{name: "run", content: "#!/usr/bin/env -S node --harmony\n", expected: fileTypeJavaScript},
+		{name: "index", content: "<?php\necho 1;", expected: fileTypePHP},
+		{name: "pom", content: `<?xml version="1.0"?>`, expected: fileTypeXML},
+		{name: "run.sh", content: "#!/usr/bin/env python", expected: fileTypeShell},
+		{name: "data", content: "whatever", expected: fileTypeUnknown},
+		{name: "empty", content: "", expected: fileTypeUnknown},
+	} {
+		t.Run(testCase.name+" "+testCase.expected, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), testCase.name)
+			require.NoError(t, ioutil.WriteFile(path, []byte(testCase.content), 0644))
+
+			fileType, err := detectFileType(path)
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, fileType)
+		})
+	}
+}
+
+func TestFileTypeFilter(t *testing.T) {
+	defer resetFiles()
+	affectedFiles := []string{"testdata/file_4.json", "testdata/inner_dir/inner_inner_dir/ignore_me.json", "testdata/inner_dir/DONTREADME.md"}
+
+	cmd, _ := makeInjectCmd([]string{"--prefix=My new shiny prefix", "--file-type=json", "--file-type=markdown"})
+	err := cmd.Execute()
+	require.NoError(t, err)
+
+	changedFiles, err := getChangedFiles(originalTestFiles)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, affectedFiles, changedFiles)
+
+	cmd, _ = makeInjectCmd([]string{"--prefix=My new shiny prefix", "--file-type=cobol"})
+	err = cmd.Execute()
+	require.Error(t, err)
+}
+
+func TestPrefixPlacementAfterPreamble(t *testing.T) {
+	dir := t.TempDir()
+	original := map[string]string{
+		"run":        "#!/usr/bin/env python3\nprint()\n",
+		"index.php":  "<?php\necho 1;\n",
+		"pom.xml":    "<?xml version=\"1.0\"?>\n<project/>\n",
+		"Dockerfile": "FROM alpine\n",
+	}
+	writeTestFiles(t, dir, original)
+	args := []string{dir, "--prefix=# Copyright", "-e"}
+
+	cmd, _ := getCmd()
+	cmd.SetArgs(append([]string{"inject"}, args...))
+	err := cmd.Execute()
+	require.NoError(t, err)
+
+	assert.Equal(t, "#!/usr/bin/env python3\n# Copyright\nprint()\n", string(readFile(t, filepath.Join(dir, "run"))))
+	assert.Equal(t, "<?php\n# Copyright\necho 1;\n", string(readFile(t, filepath.Join(dir, "index.php"))))
+	assert.Equal(t, "<?xml version=\"1.0\"?>\n# Copyright\n<project/>\n", string(readFile(t, filepath.Join(dir, "pom.xml"))))
+	assert.Equal(t, "# Copyright\nFROM alpine\n", string(readFile(t, filepath.Join(dir, "Dockerfile"))))
+
+	for _, command := range []string{"inject", "check"} {
+		cmd, out := getCmd()
+		cmd.SetArgs(append([]string{command, "--changes-only"}, args...))
+		err = cmd.Execute()
+		require.NoError(t, err)
+		assert.NotContains(t, out.String(), "Injected prefix")
+	}
+
+	cmd, _ = getCmd()
+	cmd.SetArgs(append([]string{"remove"}, args...))
+	err = cmd.Execute()
+	require.NoError(t, err)
+	for name, content := range original {
+		assert.Equal(t, content, string(readFile(t, filepath.Join(dir, name))))
+	}
+
+	t.Run("preamble without line break", func(t *testing.T) {
+		path := filepath.Join(dir, "run")
+		require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh"), 0644))
+
+		_, err := injectPrefix(path, "# Copyright", true)
+		require.NoError(t, err)
+		assert.Equal(t, "#!/bin/sh\n# Copyright\n", string(readFile(t, path)))
+	})
+
+	t.Run("remove prefix injected above preamble", func(t *testing.T) {
+		path := filepath.Join(dir, "run")
+		require.NoError(t, ioutil.WriteFile(path, []byte("# Copyright\n#!/bin/sh\n"), 0644))
+
+		removed, err := removePrefix(path, "# Copyright", true)
+		require.NoError(t, err)
+		assert.True(t, removed)
+		assert.Equal(t, "#!/bin/sh\n", string(readFile(t, path)))
+	})
+}
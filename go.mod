@@ -5,5 +5,7 @@ go 1.16
 require (
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.1.3
+	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func lockFile(_ *os.File) error {
+	return fmt.Errorf("--lock is not supported on this platform")
+}
@@ -1,21 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 func main() {
 	rootCmd := rootCommand()
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		if !errors.As(err, &silentError{}) {
+			fmt.Fprintln(os.Stderr, err)
+		}
 		os.Exit(1)
 	}
 }
@@ -32,22 +41,60 @@ func rootCommand() *cobra.Command {
 
 	rootCmd.AddCommand(injectCommand())
 	rootCmd.AddCommand(removeCommand())
+	rootCmd.AddCommand(checkCommand())
+	rootCmd.AddCommand(batchCommand())
+	rootCmd.AddCommand(configCommand())
 
 	return rootCmd
 }
 
+const lockFileName = ".preffixer.lock"
+
+var errLockHeld = errors.New("lock is held by another process")
+
+const (
+	reportPathsLink   = "link"
+	reportPathsTarget = "target"
+)
+
 type opts struct {
 	rootPath    string
 	prefix      string
 	pattern     string
 	withLineEnd bool
+	changesOnly bool
+	jobs        int
+	unordered   bool
+
+	skipIfFirstLine []*regexp.Regexp
+
+	requireCleanWorktree bool
+	force                bool
+	lock                 bool
+
+	reportPaths string
+	fileTypes   []string
+
+	out io.Writer
 }
 
 func optsFlags(cmd *cobra.Command) {
 	cmd.Flags().String("pattern", "*", "File pattern specifying files to modify.")
 	cmd.Flags().String("prefix", "", "Prefix to inject or remove")
 	cmd.Flags().String("prefix-file", "", "File from which prefix to inject or remove should be read.")
+	cmd.Flags().Bool("trim-prefix-newline", false, "Remove trailing line break from prefix read from --prefix-file.")
+	cmd.Flags().Bool("require-prefix-newline", false, "Add trailing line break to prefix read from --prefix-file if it does not end with one.")
 	cmd.Flags().BoolP("with-line-end", "e", false, "Instructs app to additionally add/remove line break after prefix.")
+	cmd.Flags().Bool("changes-only", false, "List only files that were modified, omitting files left untouched.")
+	cmd.Flags().IntP("jobs", "j", 1, "Number of files to process in parallel.")
+	cmd.Flags().Bool("unordered", false, "Print per-file results as soon as they are ready instead of in traversal order.")
+	cmd.Flags().StringArray("skip-if-first-line", []string{}, "Leave alone files which first line matches the regex. Can be specified multiple times.")
+	cmd.Flags().Bool("require-clean-worktree", false, "Refuse to modify files if the root path is inside a git repository with uncommitted changes.")
+	cmd.Flags().Bool("force", false, "Run even if --require-clean-worktree check fails.")
+	cmd.Flags().Bool("lock", false, fmt.Sprintf("Lock %s file in the root path for the duration of the run, failing if another run holds it.", lockFileName))
+	cmd.Flags().StringArray("file-type", []string{}, fmt.Sprintf("Modify only files of given type, detected from file name or content. Can be specified multiple times. One of: %s.", strings.Join(knownFileTypes, ", ")))
+	cmd.Flags().String("report-paths", reportPathsLink, "When the root path is a symlink, report file paths relative to the symlink (link) or to its target (target).")
+	cmd.Flags().String("repos-from", "", fmt.Sprintf("File listing repository paths, one per line. Runs the operation in each repository according to its %s file.", configFileName))
 }
 
 func parseOpts(cmd *cobra.Command, args []string) (opts, error) {
@@ -60,6 +107,12 @@ func parseOpts(cmd *cobra.Command, args []string) (opts, error) {
 		return opts{}, fmt.Errorf("requires 1 argument [ROOT_PATH]")
 	}
 
+	trimPrefixNewline, _ := cmd.Flags().GetBool("trim-prefix-newline")
+	requirePrefixNewline, _ := cmd.Flags().GetBool("require-prefix-newline")
+	if trimPrefixNewline && requirePrefixNewline {
+		return opts{}, fmt.Errorf("--trim-prefix-newline and --require-prefix-newline cannot be used together")
+	}
+
 	prefix, _ := cmd.Flags().GetString("prefix")
 	if prefix == "" {
 		prefixFile, _ := cmd.Flags().GetString("prefix-file")
@@ -68,6 +121,9 @@ func parseOpts(cmd *cobra.Command, args []string) (opts, error) {
 		if err != nil {
 			return opts{}, errors.Wrap(err, "failed to load content of prefix file")
 		}
+		prefix = adjustPrefixNewline(prefix, trimPrefixNewline, requirePrefixNewline)
+	} else if trimPrefixNewline || requirePrefixNewline {
+		return opts{}, fmt.Errorf("--trim-prefix-newline and --require-prefix-newline can only be used with --prefix-file")
 	}
 	if prefix == "" {
 		return opts{}, fmt.Errorf("prefix not provided, specify --prefix or --prefix-file")
@@ -76,26 +132,103 @@ func parseOpts(cmd *cobra.Command, args []string) (opts, error) {
 	pattern, _ := cmd.Flags().GetString("pattern")
 	withLineEnd, _ := cmd.Flags().GetBool("with-line-end")
 
+	options, err := parseRunOpts(cmd)
+	if err != nil {
+		return opts{}, err
+	}
+	options.rootPath = path
+	options.prefix = prefix
+	options.pattern = pattern
+	options.withLineEnd = withLineEnd
+
+	return options, nil
+}
+
+// parseRunOpts parses options controlling how files are processed, which are
+// independent of the root path and the prefix.
+func parseRunOpts(cmd *cobra.Command) (opts, error) {
+	changesOnly, _ := cmd.Flags().GetBool("changes-only")
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	if jobs < 1 {
+		return opts{}, fmt.Errorf("--jobs must be at least 1")
+	}
+	unordered, _ := cmd.Flags().GetBool("unordered")
+
+	skipPatterns, _ := cmd.Flags().GetStringArray("skip-if-first-line")
+	skipIfFirstLine := make([]*regexp.Regexp, 0, len(skipPatterns))
+	for _, p := range skipPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return opts{}, errors.Wrapf(err, "invalid --skip-if-first-line pattern %q", p)
+		}
+		skipIfFirstLine = append(skipIfFirstLine, re)
+	}
+
+	requireCleanWorktree, _ := cmd.Flags().GetBool("require-clean-worktree")
+	force, _ := cmd.Flags().GetBool("force")
+	lock, _ := cmd.Flags().GetBool("lock")
+
+	reportPaths, _ := cmd.Flags().GetString("report-paths")
+	if reportPaths != reportPathsLink && reportPaths != reportPathsTarget {
+		return opts{}, fmt.Errorf("invalid --report-paths value %q, expected %s or %s", reportPaths, reportPathsLink, reportPathsTarget)
+	}
+
+	fileTypes, _ := cmd.Flags().GetStringArray("file-type")
+	for _, ft := range fileTypes {
+		if !isKnownFileType(ft) {
+			return opts{}, fmt.Errorf("unknown --file-type %q, expected one of: %s", ft, strings.Join(knownFileTypes, ", "))
+		}
+	}
+
 	return opts{
-		rootPath:    path,
-		prefix:      prefix,
-		pattern:     pattern,
-		withLineEnd: withLineEnd,
+		changesOnly: changesOnly,
+		jobs:        jobs,
+		unordered:   unordered,
+
+		skipIfFirstLine: skipIfFirstLine,
+
+		requireCleanWorktree: requireCleanWorktree,
+		force:                force,
+		lock:                 lock,
+
+		reportPaths: reportPaths,
+		fileTypes:   fileTypes,
+
+		out: cmd.OutOrStdout(),
 	}, nil
 }
 
+// operation modifies files down the root path according to options.
+type operation func(options opts) (runSummary, error)
+
+func runOperation(cmd *cobra.Command, args []string, op operation) error {
+	reposFrom, _ := cmd.Flags().GetString("repos-from")
+	if reposFrom != "" {
+		return runReposOperation(cmd, args, reposFrom, op)
+	}
+
+	opts, err := parseOpts(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := acquireLock(opts)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = op(opts)
+	return err
+}
+
 func injectCommand() *cobra.Command {
 	newCmd := &cobra.Command{
 		Use:     "inject",
 		Short:   "Inject prefix to all files down the root path matching the pattern, that does not already start with it.",
 		Example: `preffixer inject ./e2e-tests --prefix "//+build e2e" --pattern *.go"`,
-		Args:    cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			opts, err := parseOpts(cmd, args)
-			if err != nil {
-				return err
-			}
-			return injectCmd(opts)
+			return runOperation(cmd, args, injectCmd)
 		},
 	}
 	optsFlags(newCmd)
@@ -108,101 +241,628 @@ func removeCommand() *cobra.Command {
 		Aliases: []string{"rm"},
 		Short:   "Remove prefix from all files down the root path matching the pattern.",
 		Example: `preffixer remove ./e2e-tests --prefix "//+build e2e" --pattern *.go"`,
-		Args:    cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			opts, err := parseOpts(cmd, args)
-			if err != nil {
+			return runOperation(cmd, args, removeCmd)
+		},
+	}
+	optsFlags(newCmd)
+	return newCmd
+}
+
+// silentError is returned when the error should be communicated only through the exit code.
+type silentError struct {
+	error
+}
+
+func checkCommand() *cobra.Command {
+	newCmd := &cobra.Command{
+		Use:     "check",
+		Short:   "Check that all files down the root path matching the pattern start with the prefix. Exits with non-zero code otherwise.",
+		Example: `if preffixer check ./e2e-tests --prefix "//+build e2e" --pattern "*.go" --silent; then echo "All good"; fi`,
+		// Flags are parsed in RunE, so that --silent covers flag errors as well
+		DisableFlagParsing: true,
+		// Errors are printed by main unless --silent is set
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := cmd.Flags().Parse(args); err != nil {
+				if silentRequested(cmd, args) {
+					return silentError{err}
+				}
 				return err
 			}
-			return removeCmd(opts)
+			if help, _ := cmd.Flags().GetBool("help"); help {
+				return cmd.Help()
+			}
+
+			silent, _ := cmd.Flags().GetBool("silent")
+			if !silent {
+				return runOperation(cmd, cmd.Flags().Args(), checkCmd)
+			}
+
+			cmd.SetOut(ioutil.Discard)
+			if err := runOperation(cmd, cmd.Flags().Args(), checkCmd); err != nil {
+				return silentError{err}
+			}
+			return nil
 		},
 	}
 	optsFlags(newCmd)
+	newCmd.Flags().Bool("silent", false, "Do not print anything, communicate the result only through the exit code.")
+	// Check does not modify files
+	_ = newCmd.Flags().MarkHidden("require-clean-worktree")
+	_ = newCmd.Flags().MarkHidden("force")
+	_ = newCmd.Flags().MarkHidden("lock")
+	return newCmd
+}
+
+// silentRequested reports whether --silent is set in args which failed to parse.
+// As parsing stops at the first invalid flag, args are parsed again ignoring
+// unknown flags.
+func silentRequested(cmd *cobra.Command, args []string) bool {
+	if silent, err := cmd.Flags().GetBool("silent"); err == nil && silent {
+		return true
+	}
+
+	flags := pflag.NewFlagSet(cmd.Name(), pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.SetOutput(ioutil.Discard)
+	flags.AddFlagSet(cmd.Flags())
+	_ = flags.Parse(args)
+
+	silent, err := flags.GetBool("silent")
+	return err == nil && silent
+}
+
+func batchCommand() *cobra.Command {
+	newCmd := &cobra.Command{
+		Use:   "batch",
+		Short: "Read newline-delimited JSON operations from stdin and execute them, printing one JSON result per operation.",
+		Long: `Read newline-delimited JSON operations from stdin and execute them, printing one JSON result per operation.
+
+Each operation has the form:
+  {"path": "main.go", "op": "inject", "prefix_id": "build-tag", "with_line_end": true}
+
+Operation "op" is either "inject" or "remove". Prefixes are referenced by IDs registered with --prefix or --prefix-file.`,
+		Example: `preffixer batch --prefix "e2e=//+build e2e" --prefix-file "license=./hack/license.txt"`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			prefixes, err := parseBatchPrefixes(cmd)
+			if err != nil {
+				return err
+			}
+			return batchCmd(cmd.InOrStdin(), cmd.OutOrStdout(), prefixes)
+		},
+	}
+	newCmd.Flags().StringArray("prefix", []string{}, "Prefix available to operations in form ID=PREFIX. Can be specified multiple times.")
+	newCmd.Flags().StringArray("prefix-file", []string{}, "File from which prefix available to operations should be read, in form ID=FILE_PATH. Can be specified multiple times.")
 	return newCmd
 }
 
-func injectCmd(options opts) error {
-	fmt.Println("Prefix: ", options.prefix)
-	fmt.Println("Pattern: ", options.pattern)
+type batchOperation struct {
+	Path        string `json:"path"`
+	Op          string `json:"op"`
+	PrefixID    string `json:"prefix_id"`
+	WithLineEnd bool   `json:"with_line_end"`
+}
+
+type batchResult struct {
+	Path    string `json:"path"`
+	Op      string `json:"op"`
+	Changed bool   `json:"changed"`
+	Error   string `json:"error,omitempty"`
+}
+
+func parseBatchPrefixes(cmd *cobra.Command) (map[string]string, error) {
+	prefixes := map[string]string{}
+
+	rawPrefixes, _ := cmd.Flags().GetStringArray("prefix")
+	for _, p := range rawPrefixes {
+		id, prefix, err := splitPrefixID(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid --prefix")
+		}
+		prefixes[id] = prefix
+	}
+
+	prefixFiles, _ := cmd.Flags().GetStringArray("prefix-file")
+	for _, p := range prefixFiles {
+		id, prefixFile, err := splitPrefixID(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid --prefix-file")
+		}
+		prefix, err := loadFile(prefixFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load content of prefix file for %q", id)
+		}
+		prefixes[id] = prefix
+	}
+
+	return prefixes, nil
+}
+
+func splitPrefixID(value string) (string, string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("expected ID=VALUE, got %q", value)
+	}
+	return parts[0], parts[1], nil
+}
 
-	files, err := getFilePaths(options.rootPath, options.pattern)
+func batchCmd(in io.Reader, out io.Writer, prefixes map[string]string) error {
+	scanner := bufio.NewScanner(in)
+	encoder := json.NewEncoder(out)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var operation batchOperation
+		var result batchResult
+		if err := json.Unmarshal([]byte(line), &operation); err != nil {
+			result = batchResult{Error: fmt.Sprintf("failed to parse operation: %s", err)}
+		} else {
+			result = executeBatchOperation(operation, prefixes)
+		}
+
+		if err := encoder.Encode(result); err != nil {
+			return errors.Wrap(err, "failed to write operation result")
+		}
+	}
+
+	return errors.Wrap(scanner.Err(), "failed to read operations")
+}
+
+func executeBatchOperation(operation batchOperation, prefixes map[string]string) batchResult {
+	result := batchResult{Path: operation.Path, Op: operation.Op}
+
+	prefix, found := prefixes[operation.PrefixID]
+	if !found {
+		result.Error = fmt.Sprintf("unknown prefix ID %q", operation.PrefixID)
+		return result
+	}
+	if operation.Path == "" {
+		result.Error = "path not provided"
+		return result
+	}
+
+	var err error
+	switch operation.Op {
+	case "inject":
+		result.Changed, err = injectPrefix(operation.Path, prefix, operation.WithLineEnd)
+	case "remove":
+		result.Changed, err = removePrefix(operation.Path, prefix, operation.WithLineEnd)
+	default:
+		err = fmt.Errorf("unknown operation %q, expected inject or remove", operation.Op)
+	}
 	if err != nil {
-		return err
+		result.Error = err.Error()
 	}
 
-	fmt.Println()
-	fmt.Println("Starting injection")
-	fmt.Println()
+	return result
+}
+
+func injectCmd(options opts) (runSummary, error) {
+	if err := verifyCleanWorktree(options); err != nil {
+		return runSummary{}, err
+	}
+
+	fmt.Fprintln(options.out, "Prefix: ", options.prefix)
+	fmt.Fprintln(options.out, "Pattern: ", options.pattern)
+
+	files, err := getFilePaths(options)
+	if err != nil {
+		return runSummary{}, err
+	}
+
+	fmt.Fprintln(options.out)
+	fmt.Fprintln(options.out, "Starting injection")
+	fmt.Fprintln(options.out)
+
+	summary := processFiles(options, files, func(f string) fileResult {
+		skip, err := firstLineMatches(f, options.skipIfFirstLine)
+		if err != nil {
+			return fileResult{status: fileFailed, message: fmt.Sprintf("Error reading first line of file %s: %s", f, err)}
+		}
+		if skip {
+			if options.changesOnly {
+				return fileResult{status: fileSkipped}
+			}
+			return fileResult{status: fileSkipped, message: fmt.Sprintf("File %s skipped, first line matches skip pattern", f)}
+		}
 
-	for _, f := range files {
 		injected, err := injectPrefix(f, options.prefix, options.withLineEnd)
 		if err != nil {
-			fmt.Println(fmt.Sprintf("Error injecting prefix to file %s: %s", f, err))
+			return fileResult{status: fileFailed, message: fmt.Sprintf("Error injecting prefix to file %s: %s", f, err)}
 		}
 		if !injected {
-			fmt.Println(fmt.Sprintf("File %s already has the prefix", f))
+			if options.changesOnly {
+				return fileResult{status: fileUnchanged}
+			}
+			return fileResult{status: fileUnchanged, message: fmt.Sprintf("File %s already has the prefix", f)}
 		}
-	}
+		if options.changesOnly {
+			return fileResult{status: fileChanged, message: fmt.Sprintf("Injected prefix to file %s", f)}
+		}
+		return fileResult{status: fileChanged}
+	})
 
-	fmt.Println()
-	fmt.Println("Injection finished")
-	return nil
+	fmt.Fprintln(options.out)
+	fmt.Fprintln(options.out, "Injection finished")
+	return summary, nil
 }
 
-func removeCmd(options opts) error {
-	fmt.Println("Prefix: ", options.prefix)
-	fmt.Println("Pattern: ", options.pattern)
+func removeCmd(options opts) (runSummary, error) {
+	if err := verifyCleanWorktree(options); err != nil {
+		return runSummary{}, err
+	}
+
+	fmt.Fprintln(options.out, "Prefix: ", options.prefix)
+	fmt.Fprintln(options.out, "Pattern: ", options.pattern)
 
-	files, err := getFilePaths(options.rootPath, options.pattern)
+	files, err := getFilePaths(options)
 	if err != nil {
-		return err
+		return runSummary{}, err
 	}
 
-	fmt.Println()
-	fmt.Println("Starting removal")
-	fmt.Println()
+	fmt.Fprintln(options.out)
+	fmt.Fprintln(options.out, "Starting removal")
+	fmt.Fprintln(options.out)
+
+	summary := processFiles(options, files, func(f string) fileResult {
+		skip, err := firstLineMatches(f, options.skipIfFirstLine)
+		if err != nil {
+			return fileResult{status: fileFailed, message: fmt.Sprintf("Error reading first line of file %s: %s", f, err)}
+		}
+		if skip {
+			if options.changesOnly {
+				return fileResult{status: fileSkipped}
+			}
+			return fileResult{status: fileSkipped, message: fmt.Sprintf("File %s skipped, first line matches skip pattern", f)}
+		}
 
-	for _, f := range files {
 		removed, err := removePrefix(f, options.prefix, options.withLineEnd)
 		if err != nil {
-			fmt.Println(fmt.Sprintf("Error removing prefix from file %s: %s", f, err))
+			return fileResult{status: fileFailed, message: fmt.Sprintf("Error removing prefix from file %s: %s", f, err)}
 		}
 		if !removed {
-			fmt.Println(fmt.Sprintf("File %s did not have the prefix", f))
+			if options.changesOnly {
+				return fileResult{status: fileUnchanged}
+			}
+			return fileResult{status: fileUnchanged, message: fmt.Sprintf("File %s did not have the prefix", f)}
+		}
+		if options.changesOnly {
+			return fileResult{status: fileChanged, message: fmt.Sprintf("Removed prefix from file %s", f)}
+		}
+		return fileResult{status: fileChanged}
+	})
+
+	fmt.Fprintln(options.out)
+	fmt.Fprintln(options.out, "Removal finished")
+	return summary, nil
+}
+
+func checkCmd(options opts) (runSummary, error) {
+	fmt.Fprintln(options.out, "Prefix: ", options.prefix)
+	fmt.Fprintln(options.out, "Pattern: ", options.pattern)
+
+	files, err := getFilePaths(options)
+	if err != nil {
+		return runSummary{}, err
+	}
+
+	fmt.Fprintln(options.out)
+	fmt.Fprintln(options.out, "Starting check")
+	fmt.Fprintln(options.out)
+
+	summary := processFiles(options, files, func(f string) fileResult {
+		skip, err := firstLineMatches(f, options.skipIfFirstLine)
+		if err != nil {
+			return fileResult{status: fileFailed, message: fmt.Sprintf("Error reading first line of file %s: %s", f, err)}
+		}
+		if skip {
+			if options.changesOnly {
+				return fileResult{status: fileSkipped}
+			}
+			return fileResult{status: fileSkipped, message: fmt.Sprintf("File %s skipped, first line matches skip pattern", f)}
 		}
+
+		found, err := hasPrefix(f, options.prefix)
+		if err != nil {
+			return fileResult{status: fileFailed, message: fmt.Sprintf("Error checking prefix of file %s: %s", f, err)}
+		}
+		if !found {
+			return fileResult{status: fileFailed, message: fmt.Sprintf("File %s is missing the prefix", f)}
+		}
+		if options.changesOnly {
+			return fileResult{status: fileUnchanged}
+		}
+		return fileResult{status: fileUnchanged, message: fmt.Sprintf("File %s has the prefix", f)}
+	})
+
+	fmt.Fprintln(options.out)
+	fmt.Fprintln(options.out, "Check finished")
+
+	if summary.failed > 0 {
+		return summary, fmt.Errorf("%d of %d files are missing the prefix or could not be checked", summary.failed, len(files))
+	}
+	return summary, nil
+}
+
+type fileStatus int
+
+const (
+	fileUnchanged fileStatus = iota
+	fileChanged
+	fileSkipped
+	fileFailed
+)
+
+type fileResult struct {
+	status  fileStatus
+	message string
+}
+
+// runSummary counts files by the outcome of processing them.
+type runSummary struct {
+	changed   int
+	unchanged int
+	skipped   int
+	failed    int
+}
+
+func (s *runSummary) add(other runSummary) {
+	s.changed += other.changed
+	s.unchanged += other.unchanged
+	s.skipped += other.skipped
+	s.failed += other.failed
+}
+
+func (s *runSummary) count(status fileStatus) {
+	switch status {
+	case fileChanged:
+		s.changed++
+	case fileUnchanged:
+		s.unchanged++
+	case fileSkipped:
+		s.skipped++
+	case fileFailed:
+		s.failed++
+	}
+}
+
+// processFiles runs process for each file using up to options.jobs workers and
+// prints non-empty results. Results are printed in traversal order unless
+// options.unordered is set, in which case they are printed as they complete.
+func processFiles(options opts, files []string, process func(path string) fileResult) runSummary {
+	var outMux sync.Mutex
+	summary := runSummary{}
+	handleResult := func(res fileResult) {
+		outMux.Lock()
+		defer outMux.Unlock()
+		summary.count(res.status)
+		if res.message != "" {
+			fmt.Fprintln(options.out, res.message)
+		}
+	}
+
+	results := make([]chan fileResult, len(files))
+	for i := range results {
+		results[i] = make(chan fileResult, 1)
+	}
+
+	indexes := make(chan int)
+	go func() {
+		for i := range files {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < options.jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				res := process(files[i])
+				if options.unordered {
+					handleResult(res)
+					continue
+				}
+				results[i] <- res
+			}
+		}()
+	}
+
+	if !options.unordered {
+		for i := range results {
+			handleResult(<-results[i])
+		}
+	}
+	wg.Wait()
+
+	return summary
+}
+
+// verifyCleanWorktree returns an error if clean worktree is required and the root path
+// is inside a git repository with uncommitted changes.
+func verifyCleanWorktree(options opts) error {
+	if !options.requireCleanWorktree || options.force {
+		return nil
+	}
+
+	dir := options.rootPath
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	if err := exec.Command("git", "-C", dir, "rev-parse", "--is-inside-work-tree").Run(); err != nil {
+		if _, isExitErr := err.(*exec.ExitError); isExitErr {
+			// Not a git repository, nothing to protect
+			return nil
+		}
+		return errors.Wrap(err, "failed to verify git worktree status")
+	}
+
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil {
+		return errors.Wrap(err, "failed to get git worktree status")
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		// Lock file of this or another run is not a user change
+		if len(line) < 4 || filepath.Base(strings.Trim(line[3:], `"`)) == lockFileName {
+			continue
+		}
+		return fmt.Errorf("git worktree of %s has uncommitted changes, commit or stash them first or use --force", options.rootPath)
 	}
 
-	fmt.Println()
-	fmt.Println("Removal finished")
 	return nil
 }
 
-func getFilePaths(rootPath, pattern string) ([]string, error) {
-	files, err := walkMatch(rootPath, pattern)
+// acquireLock takes an exclusive lock on the lock file in the root path if locking
+// is enabled and returns function releasing it. It fails if another run holds the
+// lock. The lock is released by the system when the process exits, so lock files
+// left behind by killed runs do not block following ones.
+func acquireLock(options opts) (func(), error) {
+	if !options.lock {
+		return func() {}, nil
+	}
+
+	dir, err := resolveRoot(options.rootPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error resolving root path")
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	lockPath := filepath.Join(dir, lockFileName)
+
+	var file *os.File
+	for file == nil {
+		file, err = os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open lock file")
+		}
+		if err := lockFile(file); err != nil {
+			file.Close()
+			if err == errLockHeld {
+				owner, _ := loadFile(lockPath)
+				return nil, fmt.Errorf("root path is locked by another run (pid %s)", strings.TrimSpace(owner))
+			}
+			return nil, errors.Wrap(err, "failed to lock lock file")
+		}
+		// Previous holder removes the file on release, in which case we locked
+		// a file no one else will see and need to start over
+		if !isLockPath(file, lockPath) {
+			file.Close()
+			file = nil
+		}
+	}
+
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintln(file, os.Getpid())
+	}
+
+	return func() {
+		// Remove the file while still holding the lock, so that no other run
+		// can lock it in the meantime and remove lock created after it
+		if isLockPath(file, lockPath) {
+			os.Remove(lockPath)
+		}
+		file.Close()
+	}, nil
+}
+
+func isLockPath(file *os.File, lockPath string) bool {
+	openInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(lockPath)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(openInfo, pathInfo)
+}
+
+func getFilePaths(options opts) ([]string, error) {
+	walkRoot, err := resolveRoot(options.rootPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error resolving root path")
+	}
+	if walkRoot != options.rootPath {
+		fmt.Fprintf(options.out, "Root path %s is a symlink to %s\n", options.rootPath, walkRoot)
+	}
+
+	files, err := walkMatch(walkRoot, options.pattern)
 	if err != nil {
 		return nil, errors.Wrap(err, "error walking root path")
 	}
+	if walkRoot != options.rootPath && options.reportPaths == reportPathsLink {
+		files, err = rebasePaths(files, walkRoot, options.rootPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(options.fileTypes) > 0 {
+		files, err = filterFileTypes(files, options.fileTypes)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if len(files) == 0 {
-		fmt.Println("No files matching the pattern found")
+		fmt.Fprintln(options.out, "No files matching the pattern found")
 		return []string{}, nil
 	}
 
-	fmt.Println(fmt.Sprintf("Found %d files matching the pattern: ", len(files)))
+	if options.changesOnly {
+		fmt.Fprintf(options.out, "Found %d files matching the pattern\n", len(files))
+		return files, nil
+	}
+
+	fmt.Fprintf(options.out, "Found %d files matching the pattern: \n", len(files))
 	for _, f := range files {
-		fmt.Println(fmt.Sprintf("  • %s", f))
+		fmt.Fprintf(options.out, "  • %s\n", f)
 	}
 
 	return files, nil
 }
 
+// resolveRoot returns the target of the root path if it is a symlink, so that it is
+// walked the same way on all platforms. Otherwise the root path is returned unchanged.
+func resolveRoot(rootPath string) (string, error) {
+	info, err := os.Lstat(rootPath)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return rootPath, nil
+	}
+	return filepath.EvalSymlinks(rootPath)
+}
+
+func rebasePaths(paths []string, oldBase, newBase string) ([]string, error) {
+	rebased := make([]string, 0, len(paths))
+	for _, p := range paths {
+		rel, err := filepath.Rel(oldBase, p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to rebase path %s", p)
+		}
+		rebased = append(rebased, filepath.Join(newBase, rel))
+	}
+	return rebased, nil
+}
+
 func walkMatch(root, pattern string) ([]string, error) {
 	var matches []string
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
+		if info.IsDir() || info.Name() == lockFileName {
 			return nil
 		}
 		matched, err := filepath.Match(pattern, filepath.Base(path))
@@ -226,15 +886,20 @@ func injectPrefix(path string, prefix string, lineEnd bool) (bool, error) {
 		return false, err
 	}
 
-	if strings.HasPrefix(string(content), prefix) {
+	preamble, rest, found := locatePrefix(string(content), prefix)
+	if found {
 		return false, nil
 	}
+	if preamble != "" && !strings.HasSuffix(preamble, "\n") {
+		preamble += "\n"
+	}
 
-	newContent := []byte(prefix)
+	newContent := []byte(preamble)
+	newContent = append(newContent, prefix...)
 	if lineEnd {
 		newContent = append(newContent, '\n')
 	}
-	newContent = append(newContent, content...)
+	newContent = append(newContent, rest...)
 
 	err = os.WriteFile(path, newContent, os.ModeType)
 	if err != nil {
@@ -250,15 +915,16 @@ func removePrefix(path string, prefix string, lineEnd bool) (bool, error) {
 		return false, err
 	}
 
-	if !strings.HasPrefix(string(content), prefix) {
+	preamble, rest, found := locatePrefix(string(content), prefix)
+	if !found {
 		return false, nil
 	}
-	newStr := strings.TrimPrefix(string(content), prefix)
+	newStr := strings.TrimPrefix(rest, prefix)
 	if lineEnd {
 		newStr = strings.TrimPrefix(newStr, "\n")
 	}
 
-	err = os.WriteFile(path, []byte(newStr), os.ModeType)
+	err = os.WriteFile(path, []byte(preamble+newStr), os.ModeType)
 	if err != nil {
 		return false, err
 	}
@@ -266,6 +932,62 @@ func removePrefix(path string, prefix string, lineEnd bool) (bool, error) {
 	return true, nil
 }
 
+// firstLineMatches reports whether the first line of the file matches any of the patterns.
+func firstLineMatches(path string, patterns []*regexp.Regexp) (bool, error) {
+	if len(patterns) == 0 {
+		return false, nil
+	}
+
+	firstLine, err := readFirstLine(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range patterns {
+		if p.MatchString(firstLine) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func readFirstLine(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	firstLine, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(firstLine, "\r\n"), nil
+}
+
+func hasPrefix(path string, prefix string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	_, _, found := locatePrefix(string(content), prefix)
+	return found, nil
+}
+
+// adjustPrefixNewline trims or adds a single trailing line break of the prefix,
+// as editors differ in whether they end files with one.
+func adjustPrefixNewline(prefix string, trim, require bool) string {
+	hasNewline := strings.HasSuffix(prefix, "\n")
+	switch {
+	case trim && hasNewline:
+		return strings.TrimSuffix(strings.TrimSuffix(prefix, "\n"), "\r")
+	case require && !hasNewline && prefix != "":
+		return prefix + "\n"
+	}
+	return prefix
+}
+
 func loadFile(filePath string) (string, error) {
 	if filePath == "" {
 		return "", nil
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -179,6 +182,383 @@ Much wow
 	}
 }
 
+func TestChangesOnly(t *testing.T) {
+	defer resetFiles()
+	args := []string{"--pattern=*.txt", "--prefix=My new shiny prefix", "--changes-only"}
+
+	cmd, out := makeInjectCmd(args)
+	err := cmd.Execute()
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "Injected prefix to file testdata/file_1.txt")
+	assert.NotContains(t, out.String(), "•")
+
+	cmd, out = makeInjectCmd(args)
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.NotContains(t, out.String(), "Injected prefix")
+	assert.NotContains(t, out.String(), "already has the prefix")
+
+	cmd, out = makeRemoveCmd(args)
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "Removed prefix from file testdata/inner_dir/file_2.txt")
+	assertMatchOriginal(t, originalTestFiles)
+}
+
+func TestParallelJobs(t *testing.T) {
+	defer resetFiles()
+	args := []string{"--prefix=My new shiny prefix"}
+
+	cmd, _ := makeInjectCmd(args)
+	err := cmd.Execute()
+	require.NoError(t, err)
+
+	cmd, sequentialOut := makeInjectCmd(args)
+	err = cmd.Execute()
+	require.NoError(t, err)
+
+	cmd, parallelOut := makeInjectCmd(append(args, "--jobs=4"))
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Equal(t, sequentialOut.String(), parallelOut.String())
+
+	cmd, _ = makeRemoveCmd(append(args, "--jobs=4", "--unordered"))
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assertMatchOriginal(t, originalTestFiles)
+}
+
+func TestSkipIfFirstLine(t *testing.T) {
+	defer resetFiles()
+	affectedFiles := []string{"testdata/file_1.txt", "testdata/inner_dir/inner_inner_dir/file_3.txt"}
+	args := []string{"--pattern=*.txt", "--prefix=My new shiny prefix", "--skip-if-first-line=^This is file 2\\.$"}
+
+	cmd, out := makeInjectCmd(args)
+	err := cmd.Execute()
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "File testdata/inner_dir/file_2.txt skipped")
+
+	changedFiles, err := getChangedFiles(originalTestFiles)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, affectedFiles, changedFiles)
+
+	cmd, _ = makeInjectCmd([]string{"--prefix=My new shiny prefix", "--skip-if-first-line=("})
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid --skip-if-first-line pattern")
+}
+
+func TestBatch(t *testing.T) {
+	defer resetFiles()
+
+	operations := `{"path": "testdata/file_1.txt", "op": "inject", "prefix_id": "shiny", "with_line_end": true}
+{"path": "testdata/file_1.txt", "op": "inject", "prefix_id": "shiny", "with_line_end": true}
+
+{"path": "testdata/inner_dir/file_2.txt", "op": "inject", "prefix_id": "from-file"}
+{"path": "testdata/inner_dir/file_2.txt", "op": "inject", "prefix_id": "unknown"}
+{"path": "testdata/inner_dir/file_2.txt", "op": "replace", "prefix_id": "shiny"}
+not a json
+`
+	cmd, out := getCmd()
+	cmd.SetIn(strings.NewReader(operations))
+	cmd.SetArgs([]string{"batch", "--prefix=shiny=My new shiny prefix", "--prefix-file=from-file=testdata/file_with_prefix"})
+	err := cmd.Execute()
+	require.NoError(t, err)
+
+	results := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, results, 6)
+	assert.Equal(t, `{"path":"testdata/file_1.txt","op":"inject","changed":true}`, results[0])
+	assert.Equal(t, `{"path":"testdata/file_1.txt","op":"inject","changed":false}`, results[1])
+	assert.Equal(t, `{"path":"testdata/inner_dir/file_2.txt","op":"inject","changed":true}`, results[2])
+	assert.Contains(t, results[3], `unknown prefix ID`)
+	assert.Contains(t, results[4], `unknown operation`)
+	assert.Contains(t, results[5], `failed to parse operation`)
+
+	assertHavePrefix(t, []string{"testdata/file_1.txt"}, "My new shiny prefix\n", originalTestFiles)
+	assertHavePrefix(t, []string{"testdata/inner_dir/file_2.txt"}, string(originalTestFiles["testdata/file_with_prefix"]), originalTestFiles)
+
+	cmd, _ = getCmd()
+	cmd.SetIn(strings.NewReader(`{"path": "testdata/file_1.txt", "op": "remove", "prefix_id": "shiny", "with_line_end": true}`))
+	cmd.SetArgs([]string{"batch", "--prefix=shiny=My new shiny prefix"})
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Equal(t, originalTestFiles["testdata/file_1.txt"], readFile(t, "testdata/file_1.txt"))
+}
+
+func TestRequireCleanWorktree(t *testing.T) {
+	repoDir := t.TempDir()
+	filePath := filepath.Join(repoDir, "file.txt")
+	require.NoError(t, ioutil.WriteFile(filePath, []byte("content"), 0644))
+
+	initGitRepo(t, repoDir)
+
+	args := []string{"inject", repoDir, "--pattern=*.txt", "--prefix=My new shiny prefix", "--require-clean-worktree"}
+
+	cmd, _ := getCmd()
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	require.NoError(t, err)
+	assert.Equal(t, "My new shiny prefixcontent", string(readFile(t, filePath)))
+
+	cmd, _ = getCmd()
+	cmd.SetArgs(append([]string{"remove"}, args[1:]...))
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "uncommitted changes")
+	assert.Equal(t, "My new shiny prefixcontent", string(readFile(t, filePath)))
+
+	cmd, _ = getCmd()
+	cmd.SetArgs(append([]string{"remove"}, append(args[1:], "--force")...))
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(readFile(t, filePath)))
+}
+
+func TestSymlinkedRoot(t *testing.T) {
+	defer resetFiles()
+	affectedFiles := []string{
+		"testdata/file_1.txt", "testdata/inner_dir/file_2.txt", "testdata/inner_dir/inner_inner_dir/file_3.txt",
+	}
+
+	target, err := filepath.Abs("testdata")
+	require.NoError(t, err)
+	link := filepath.Join(t.TempDir(), "link")
+	require.NoError(t, os.Symlink(target, link))
+
+	cmd, out := getCmd()
+	cmd.SetArgs([]string{"inject", link, "--pattern=*.txt", "--prefix=My new shiny prefix"})
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), fmt.Sprintf("Root path %s is a symlink to %s", link, target))
+	assert.Contains(t, out.String(), filepath.Join(link, "inner_dir/file_2.txt"))
+	assertHavePrefix(t, affectedFiles, "My new shiny prefix", originalTestFiles)
+
+	cmd, out = getCmd()
+	cmd.SetArgs([]string{"remove", link, "--pattern=*.txt", "--prefix=My new shiny prefix", "--report-paths=target"})
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), filepath.Join(target, "inner_dir/file_2.txt"))
+	assert.NotContains(t, out.String(), filepath.Join(link, "inner_dir/file_2.txt"))
+	assertMatchOriginal(t, originalTestFiles)
+}
+
+func TestCheck(t *testing.T) {
+	defer resetFiles()
+	args := []string{"--pattern=*.txt", "--prefix=My new shiny prefix"}
+
+	cmd, out := makeCheckCmd(args)
+	err := cmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, out.String(), "File testdata/file_1.txt is missing the prefix")
+
+	cmd, out = makeCheckCmd(append(args, "--silent"))
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.True(t, errors.As(err, &silentError{}))
+	assert.Empty(t, out.String())
+
+	cmd, out = makeCheckCmd(append(args, "--silent", "--bogus"))
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.True(t, errors.As(err, &silentError{}))
+	assert.Empty(t, out.String())
+
+	cmd, out = makeCheckCmd(append(args, "--bogus", "--silent"))
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.True(t, errors.As(err, &silentError{}))
+	assert.Empty(t, out.String())
+
+	cmd, out = makeCheckCmd(append(args, "--bogus"))
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &silentError{}))
+	assert.Contains(t, err.Error(), "unknown flag: --bogus")
+
+	// --silent is a value of --prefix here
+	cmd, out = makeCheckCmd([]string{"--pattern=*.txt", "--prefix", "--silent"})
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &silentError{}))
+	assert.Contains(t, out.String(), "File testdata/file_1.txt is missing the prefix")
+
+	cmd, _ = makeInjectCmd(args)
+	err = cmd.Execute()
+	require.NoError(t, err)
+
+	cmd, out = makeCheckCmd(append(args, "--silent"))
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Empty(t, out.String())
+
+	cmd, out = makeCheckCmd(args)
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "File testdata/file_1.txt has the prefix")
+}
+
+func TestPrefixFileNewline(t *testing.T) {
+	prefixFile := "testdata/file_with_prefix"
+	prefix := string(originalTestFiles[prefixFile])
+	require.True(t, strings.HasSuffix(prefix, "\n"))
+	prefixWithoutNewline := strings.TrimSuffix(prefix, "\n")
+
+	noNewlineFile := filepath.Join(t.TempDir(), "prefix")
+	require.NoError(t, ioutil.WriteFile(noNewlineFile, []byte(prefixWithoutNewline), 0644))
+
+	for _, testCase := range []struct {
+		description    string
+		prefixFile     string
+		flag           string
+		expectedPrefix string
+	}{
+		{
+			description:    "trim newline",
+			prefixFile:     prefixFile,
+			flag:           "--trim-prefix-newline",
+			expectedPrefix: prefixWithoutNewline,
+		},
+		{
+			description:    "require newline when missing",
+			prefixFile:     noNewlineFile,
+			flag:           "--require-prefix-newline",
+			expectedPrefix: prefix,
+		},
+		{
+			description:    "require newline when present",
+			prefixFile:     prefixFile,
+			flag:           "--require-prefix-newline",
+			expectedPrefix: prefix,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			defer resetFiles()
+			args := []string{"--pattern=*.txt", fmt.Sprintf("--prefix-file=%s", testCase.prefixFile), testCase.flag, "-e"}
+
+			cmd, _ := makeInjectCmd(args)
+			err := cmd.Execute()
+			require.NoError(t, err)
+			assertHavePrefix(t, []string{"testdata/file_1.txt"}, testCase.expectedPrefix+"\n", originalTestFiles)
+
+			cmd, _ = makeRemoveCmd(args)
+			err = cmd.Execute()
+			require.NoError(t, err)
+			assertMatchOriginal(t, originalTestFiles)
+		})
+	}
+
+	t.Run("reject both flags", func(t *testing.T) {
+		cmd, _ := makeInjectCmd([]string{fmt.Sprintf("--prefix-file=%s", prefixFile), "--trim-prefix-newline", "--require-prefix-newline"})
+		err := cmd.Execute()
+		require.Error(t, err)
+	})
+}
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	lockPath := filepath.Join(dir, lockFileName)
+	require.NoError(t, ioutil.WriteFile(filePath, []byte("content"), 0644))
+	args := []string{"inject", dir, "--prefix=My new shiny prefix", "--lock"}
+
+	unlock, err := acquireLock(opts{rootPath: dir, lock: true})
+	require.NoError(t, err)
+	cmd, _ := getCmd()
+	cmd.SetArgs(args)
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("locked by another run (pid %d)", os.Getpid()))
+	assert.Equal(t, "content", string(readFile(t, filePath)))
+
+	unlock()
+	cmd, _ = getCmd()
+	cmd.SetArgs(args)
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Equal(t, "My new shiny prefixcontent", string(readFile(t, filePath)))
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err))
+
+	t.Run("take over stale lock", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(lockPath, []byte("12345\n"), 0644))
+
+		cmd, _ := getCmd()
+		cmd.SetArgs([]string{"remove", dir, "--prefix=My new shiny prefix", "--lock"})
+		err := cmd.Execute()
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(readFile(t, filePath)))
+		_, err = os.Stat(lockPath)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("only one of concurrent runs takes over stale lock", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(lockPath, []byte("12345\n"), 0644))
+
+		const runs = 8
+		start := make(chan struct{})
+		results := make(chan error, runs)
+		unlocks := make(chan func(), runs)
+		wg := &sync.WaitGroup{}
+		for i := 0; i < runs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				unlock, err := acquireLock(opts{rootPath: dir, lock: true})
+				if err == nil {
+					unlocks <- unlock
+				}
+				results <- err
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(results)
+		close(unlocks)
+
+		failed := 0
+		for err := range results {
+			if err != nil {
+				assert.Contains(t, err.Error(), "locked by another run")
+				failed++
+			}
+		}
+		assert.Equal(t, runs-1, failed)
+
+		for unlock := range unlocks {
+			unlock()
+		}
+		_, err := os.Stat(lockPath)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestLockWithRequireCleanWorktree(t *testing.T) {
+	repoDir := t.TempDir()
+	filePath := filepath.Join(repoDir, "file.txt")
+	require.NoError(t, ioutil.WriteFile(filePath, []byte("content"), 0644))
+
+	initGitRepo(t, repoDir)
+
+	args := []string{"inject", repoDir, "--pattern=*.txt", "--prefix=My new shiny prefix", "--require-clean-worktree", "--lock"}
+
+	unlock, err := acquireLock(opts{rootPath: repoDir, lock: true})
+	require.NoError(t, err)
+	cmd, _ := getCmd()
+	cmd.SetArgs(args)
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "locked by another run")
+	assert.Equal(t, "content", string(readFile(t, filePath)))
+
+	unlock()
+	cmd, _ = getCmd()
+	cmd.SetArgs(args)
+	err = cmd.Execute()
+	require.NoError(t, err)
+	assert.Equal(t, "My new shiny prefixcontent", string(readFile(t, filePath)))
+}
+
 func makeInjectCmd(args []string) (*cobra.Command, *bytes.Buffer) {
 	injectArgs := []string{"inject", "testdata"}
 	cmd, buff := getCmd()
@@ -193,6 +573,13 @@ func makeRemoveCmd(args []string) (*cobra.Command, *bytes.Buffer) {
 	return cmd, buff
 }
 
+func makeCheckCmd(args []string) (*cobra.Command, *bytes.Buffer) {
+	checkArgs := []string{"check", "testdata"}
+	cmd, buff := getCmd()
+	cmd.SetArgs(append(checkArgs, args...))
+	return cmd, buff
+}
+
 func getCmd() (*cobra.Command, *bytes.Buffer) {
 	rootCmd := rootCommand()
 
@@ -223,6 +610,24 @@ func assertHavePrefix(t *testing.T, files []string, prefix string, original map[
 	}
 }
 
+func runGit(t *testing.T, dir string, args ...string) {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+// initGitRepo initializes git repository in dir and commits all its files.
+func initGitRepo(t *testing.T, dir string) {
+	runGit(t, dir, "init", "-q")
+	runGit(t, dir, "add", "-A")
+	runGit(t, dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial")
+}
+
+func readFile(t *testing.T, path string) []byte {
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return content
+}
+
 func assertMatchOriginal(t *testing.T, original map[string][]byte) {
 	for p, v := range original {
 		content, err := ioutil.ReadFile(p)
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+type repoReport struct {
+	path    string
+	summary runSummary
+	err     error
+}
+
+func runReposOperation(cmd *cobra.Command, args []string, reposFrom string, op operation) error {
+	if len(args) > 0 {
+		return fmt.Errorf("ROOT_PATH cannot be specified together with --repos-from")
+	}
+	for _, flag := range []string{"prefix", "prefix-file", "trim-prefix-newline", "require-prefix-newline", "pattern", "with-line-end"} {
+		if cmd.Flags().Changed(flag) {
+			return fmt.Errorf("--%s cannot be used with --repos-from, rules are read from %s of each repository", flag, configFileName)
+		}
+	}
+
+	options, err := parseRunOpts(cmd)
+	if err != nil {
+		return err
+	}
+
+	repos, err := loadReposList(reposFrom)
+	if err != nil {
+		return errors.Wrap(err, "failed to load repositories list")
+	}
+
+	reports := make([]repoReport, 0, len(repos))
+	for _, repo := range repos {
+		fmt.Fprintf(options.out, "Repository: %s\n", repo)
+		fmt.Fprintln(options.out)
+
+		summary, err := runRepoOperation(repo, options, op)
+		if err != nil {
+			fmt.Fprintf(options.out, "Error processing repository %s: %s\n", repo, err)
+		}
+		reports = append(reports, repoReport{path: repo, summary: summary, err: err})
+		fmt.Fprintln(options.out)
+	}
+
+	return printReposReport(options, reports)
+}
+
+func runRepoOperation(repo string, options opts, op operation) (runSummary, error) {
+	rules, err := loadConfig(filepath.Join(repo, configFileName))
+	if err != nil {
+		return runSummary{}, err
+	}
+
+	repoOptions := options
+	repoOptions.rootPath = repo
+
+	// Hold the lock for all rules, so that no other run modifies the repository in between
+	unlock, err := acquireLock(repoOptions)
+	if err != nil {
+		return runSummary{}, err
+	}
+	defer unlock()
+
+	// Verify the worktree once, as files changed by one rule would fail the check for the next ones
+	if err := verifyCleanWorktree(repoOptions); err != nil {
+		return runSummary{}, err
+	}
+	repoOptions.requireCleanWorktree = false
+
+	summary := runSummary{}
+	ruleErrs := []string{}
+	for i, rule := range rules {
+		ruleOptions := repoOptions
+		ruleOptions.prefix = rule.prefix
+		ruleOptions.pattern = rule.Pattern
+		ruleOptions.withLineEnd = rule.WithLineEnd
+
+		// Apply remaining rules even if one fails, so that the report covers all of them
+		ruleSummary, err := op(ruleOptions)
+		summary.add(ruleSummary)
+		if err != nil {
+			ruleErrs = append(ruleErrs, fmt.Sprintf("failed to apply rule %d: %s", i+1, err))
+		}
+	}
+
+	if len(ruleErrs) > 0 {
+		return summary, errors.New(strings.Join(ruleErrs, "; "))
+	}
+	return summary, nil
+}
+
+// loadReposList reads repository paths from the file, one per line, ignoring
+// empty lines and lines starting with #.
+func loadReposList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	repos := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		repos = append(repos, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(repos) == 0 {
+		return nil, fmt.Errorf("no repositories listed in %s", path)
+	}
+	return repos, nil
+}
+
+func printReposReport(options opts, reports []repoReport) error {
+	fmt.Fprintln(options.out, "Combined report:")
+	fmt.Fprintln(options.out)
+
+	writer := tabwriter.NewWriter(options.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "REPOSITORY\tCHANGED\tUNCHANGED\tSKIPPED\tFAILED\tERROR")
+
+	total := runSummary{}
+	failedRepos := 0
+	for _, r := range reports {
+		errMsg := ""
+		if r.err != nil {
+			// Keep multiline errors, like YAML ones, in a single table row
+			errMsg = strings.Join(strings.Fields(r.err.Error()), " ")
+			failedRepos++
+		}
+		total.add(r.summary)
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%d\t%s\n", r.path, r.summary.changed, r.summary.unchanged, r.summary.skipped, r.summary.failed, errMsg)
+	}
+	fmt.Fprintf(writer, "TOTAL\t%d\t%d\t%d\t%d\t\n", total.changed, total.unchanged, total.skipped, total.failed)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if failedRepos > 0 {
+		return fmt.Errorf("failed to process %d of %d repositories", failedRepos, len(reports))
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReposFrom(t *testing.T) {
+	baseDir := t.TempDir()
+
+	repoA := filepath.Join(baseDir, "repo-a")
+	writeTestFiles(t, repoA, map[string]string{
+		configFileName: `rules:
+- pattern: "*.go"
+  prefix: "//+build e2e"
+  with_line_end: true
+- pattern: "*.sh"
+  prefix_file: hack/license.txt
+`,
+		"hack/license.txt": "# Copyright\n",
+		"main.go":          "package main\n",
+		"run.sh":           "echo hello\n",
+	})
+	repoB := filepath.Join(baseDir, "repo-b")
+	writeTestFiles(t, repoB, map[string]string{
+		configFileName: `rules:
+- pattern: "*.go"
+  prefix: "//+build e2e"
+  with_line_end: true
+`,
+		"main.go": "//+build e2e\npackage main\n",
+	})
+	repoC := filepath.Join(baseDir, "repo-c")
+	writeTestFiles(t, repoC, map[string]string{"main.go": "package main\n"})
+
+	reposList := filepath.Join(baseDir, "repos.txt")
+	require.NoError(t, ioutil.WriteFile(reposList, []byte(fmt.Sprintf("# repositories\n%s\n\n%s\n", repoA, repoB)), 0644))
+
+	cmd, out := getCmd()
+	cmd.SetArgs([]string{"inject", "--repos-from", reposList})
+	err := cmd.Execute()
+	require.NoError(t, err)
+
+	assert.Equal(t, "//+build e2e\npackage main\n", string(readFile(t, filepath.Join(repoA, "main.go"))))
+	assert.Equal(t, "# Copyright\necho hello\n", string(readFile(t, filepath.Join(repoA, "run.sh"))))
+	assert.Equal(t, "//+build e2e\npackage main\n", string(readFile(t, filepath.Join(repoB, "main.go"))))
+	assert.Contains(t, out.String(), "Combined report:")
+	assertReportRow(t, out.String(), repoA, "2", "0")
+	assertReportRow(t, out.String(), repoB, "0", "1")
+	assertReportRow(t, out.String(), "TOTAL", "2", "1")
+
+	t.Run("report repository errors", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(reposList, []byte(fmt.Sprintf("%s\n%s\n", repoC, repoA)), 0644))
+
+		cmd, out := getCmd()
+		cmd.SetArgs([]string{"remove", "--repos-from", reposList})
+		err := cmd.Execute()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to process 1 of 2 repositories")
+		assert.Contains(t, out.String(), configFileName)
+		assert.Equal(t, "package main\n", string(readFile(t, filepath.Join(repoA, "main.go"))))
+	})
+
+	t.Run("reject prefix flags", func(t *testing.T) {
+		cmd, _ := getCmd()
+		cmd.SetArgs([]string{"inject", "--repos-from", reposList, "--prefix=abc"})
+		err := cmd.Execute()
+		require.Error(t, err)
+	})
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func assertReportRow(t *testing.T, output, name, changed, unchanged string) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == name {
+			assert.Equal(t, changed, fields[1])
+			assert.Equal(t, unchanged, fields[2])
+			return
+		}
+	}
+	t.Errorf("report row for %s not found", name)
+}
+
+func TestReposFromRequireCleanWorktree(t *testing.T) {
+	baseDir := t.TempDir()
+	repo := filepath.Join(baseDir, "repo")
+	writeTestFiles(t, repo, map[string]string{
+		configFileName: `rules:
+- pattern: "*.go"
+  prefix: "// Copyright"
+  with_line_end: true
+- pattern: "*.sh"
+  prefix: "# Copyright"
+  with_line_end: true
+`,
+		"m.go": "package main\n",
+		"r.sh": "echo hello\n",
+	})
+	initGitRepo(t, repo)
+
+	reposList := filepath.Join(baseDir, "repos.txt")
+	require.NoError(t, ioutil.WriteFile(reposList, []byte(repo+"\n"), 0644))
+
+	cmd, _ := getCmd()
+	cmd.SetArgs([]string{"inject", "--repos-from", reposList, "--require-clean-worktree"})
+	err := cmd.Execute()
+	require.NoError(t, err)
+	assert.Equal(t, "// Copyright\npackage main\n", string(readFile(t, filepath.Join(repo, "m.go"))))
+	assert.Equal(t, "# Copyright\necho hello\n", string(readFile(t, filepath.Join(repo, "r.sh"))))
+
+	cmd, _ = getCmd()
+	cmd.SetArgs([]string{"remove", "--repos-from", reposList, "--require-clean-worktree"})
+	err = cmd.Execute()
+	require.Error(t, err)
+	assert.Equal(t, "// Copyright\npackage main\n", string(readFile(t, filepath.Join(repo, "m.go"))))
+}
+
+func TestReposFromAppliesAllRules(t *testing.T) {
+	baseDir := t.TempDir()
+	repo := filepath.Join(baseDir, "repo")
+	writeTestFiles(t, repo, map[string]string{
+		configFileName: `rules:
+- pattern: "*.go"
+  prefix: "// Copyright"
+- pattern: "*.sh"
+  prefix: "# Copyright"
+- pattern: "*.py"
+  prefix: "# Copyright"
+`,
+		"m.go": "package main\n",
+		"r.sh": "echo hello\n",
+		"p.py": "# Copyright\nprint()\n",
+	})
+	reposList := filepath.Join(baseDir, "repos.txt")
+	require.NoError(t, ioutil.WriteFile(reposList, []byte(repo+"\n"), 0644))
+
+	cmd, out := getCmd()
+	cmd.SetArgs([]string{"check", "--repos-from", reposList})
+	err := cmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, out.String(), "failed to apply rule 1")
+	assert.Contains(t, out.String(), "failed to apply rule 2")
+	assert.NotContains(t, out.String(), "failed to apply rule 3")
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 5 && fields[0] == "TOTAL" {
+			assert.Equal(t, []string{"0", "1", "0", "2"}, fields[1:5])
+			return
+		}
+	}
+	t.Error("report row for TOTAL not found")
+}
+
+func TestReposFromHoldsLockForAllRules(t *testing.T) {
+	repo := t.TempDir()
+	writeTestFiles(t, repo, map[string]string{
+		configFileName: `rules:
+- pattern: "*.go"
+  prefix: "// Copyright"
+- pattern: "*.sh"
+  prefix: "# Copyright"
+`,
+	})
+	lockPath := filepath.Join(repo, lockFileName)
+
+	calls := 0
+	op := func(_ opts) (runSummary, error) {
+		calls++
+		_, err := os.Stat(lockPath)
+		assert.NoError(t, err, "lock should be held while applying rule %d", calls)
+		return runSummary{}, nil
+	}
+
+	_, err := runRepoOperation(repo, opts{lock: true}, op)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err))
+}